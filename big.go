@@ -0,0 +1,439 @@
+package expr
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"math/big"
+	"reflect"
+	"strconv"
+)
+
+// CompileBig compiles expr for use with Expression.EvalBig. It mirrors
+// Compile, except int and float literals are parsed straight into *big.Int
+// and *big.Rat instead of int64/float64, so a literal like
+// 123456789012345678901234567890 or an exact decimal like 0.1 survives
+// compilation without first being narrowed through strconv.ParseInt or
+// float64.
+func CompileBig(expr string) (*Expression, error) {
+	e := &Expression{Expr: expr}
+	if e.Expr == "" {
+		return e, nil
+	}
+	node, err := compileNode(expr)
+	if err != nil {
+		return nil, err
+	}
+	e.node = node
+	index(node, &e.Terms, e.funcs)
+	c := &compiler{big: true}
+	c.compile(node)
+	c.emit(opReturn, 0)
+	e.code = c.code
+	e.consts = c.consts
+	e.idents = c.idents
+	e.selectors = c.selectors
+	e.calls = c.calls
+	return e, nil
+}
+
+// bigBasicLitValue is basicLitValue's CompileBig counterpart: it parses int
+// and float literal text directly into *big.Int / *big.Rat via SetString,
+// rather than round-tripping through strconv.ParseInt/ParseFloat and
+// int64/float64 the way basicLitValue does, so large integers don't
+// overflow and decimal literals don't pick up binary-float rounding.
+func bigBasicLitValue(n *ast.BasicLit) (interface{}, error) {
+	switch n.Kind {
+	case token.STRING:
+		return strconv.Unquote(n.Value)
+	case token.INT:
+		v, ok := new(big.Int).SetString(n.Value, 0)
+		if !ok {
+			return nil, fmt.Errorf("invalid integer literal %q", n.Value)
+		}
+		return v, nil
+	case token.FLOAT:
+		v, ok := new(big.Rat).SetString(n.Value)
+		if !ok {
+			return nil, fmt.Errorf("invalid float literal %q", n.Value)
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("unsupported literal kind %s", n.Kind)
+}
+
+// EvalBig evaluates the expression via runBig instead of run, widening
+// integer and float literals and values to *big.Int and *big.Rat instead of
+// int64/float64, so callers can work with values - cryptographic-size
+// integers, exact decimal amounts - that would overflow or lose precision
+// on the native-width path.
+//
+// Division, modulo and out-of-range shift counts are reported as an error
+// rather than a panic, since they're a property of the input data rather
+// than a malformed expression.
+func (e *Expression) EvalBig(value V) (v interface{}, err error) {
+	if e.Expr == "" {
+		return "", nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	v = runBig(e, value)
+	return
+}
+
+// runBig is run's bigBinOp/boolCastBig counterpart: it walks the same
+// bytecode but operates on big.Int/big.Rat values rather than int64/float64.
+func runBig(e *Expression, value V) interface{} {
+	stack := make([]interface{}, 0, 8)
+
+	pc := 0
+	for pc < len(e.code) {
+		in := e.code[pc]
+		switch in.op {
+		case opLoadConst:
+			stack = append(stack, e.consts[in.a])
+
+		case opLoadIdent:
+			stack = append(stack, identLookup(value, e.idents[in.a]))
+
+		case opLoadSelector:
+			stack = append(stack, resolveSelector(value, e.selectors[in.a]))
+
+		case opBinop:
+			rhs := stack[len(stack)-1]
+			lhs := stack[len(stack)-2]
+			stack = stack[:len(stack)-2]
+			v, err := bigBinOp(token.Token(in.a), lhs, rhs)
+			if err != nil {
+				panic(err)
+			}
+			stack = append(stack, v)
+
+		case opUnop:
+			v := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			switch unop(in.a) {
+			case unopNot:
+				stack = append(stack, !boolCastBig(v))
+			case unopBoolCast:
+				stack = append(stack, boolCastBig(v))
+			}
+
+		case opJumpIfFalse:
+			v := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if !boolCastBig(v) {
+				pc = in.a
+				continue
+			}
+
+		case opJumpIfTrue:
+			v := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if boolCastBig(v) {
+				pc = in.a
+				continue
+			}
+
+		case opJump:
+			pc = in.a
+			continue
+
+		case opCall:
+			ci := e.calls[in.a]
+			fn, ok := e.funcs[ci.name]
+			if !ok {
+				fn, ok = defaultFuncs[ci.name]
+			}
+			if !ok {
+				panic(fmt.Errorf("unknown function %q", ci.name))
+			}
+			args := stack[len(stack)-ci.argc:]
+			native := make([]interface{}, len(args))
+			for i, a := range args {
+				native[i] = bigToNative(a)
+			}
+			result := invokeFunc(fn, native)
+			stack = stack[:len(stack)-ci.argc]
+			stack = append(stack, normalizeBig(result))
+
+		case opReturn:
+			return stack[len(stack)-1]
+
+		case opPanic:
+			panic(fmt.Errorf("%s", e.consts[in.a]))
+		}
+		pc++
+	}
+	return nil
+}
+
+// normalizeBig is normalize's bigMode counterpart: it widens ints to
+// *big.Int and floats to *big.Rat instead of int64/float64, leaving
+// strings, bools and already-big values untouched.
+func normalizeBig(v interface{}) interface{} {
+	switch rv := v.(type) {
+	case *big.Int, *big.Rat:
+		return v
+	case int:
+		return big.NewInt(int64(rv))
+	case int8:
+		return big.NewInt(int64(rv))
+	case int16:
+		return big.NewInt(int64(rv))
+	case int32:
+		return big.NewInt(int64(rv))
+	case int64:
+		return big.NewInt(rv)
+	case uint:
+		return new(big.Int).SetUint64(uint64(rv))
+	case uint8:
+		return new(big.Int).SetUint64(uint64(rv))
+	case uint16:
+		return new(big.Int).SetUint64(uint64(rv))
+	case uint32:
+		return new(big.Int).SetUint64(uint64(rv))
+	case uint64:
+		return new(big.Int).SetUint64(rv)
+	case float32:
+		return new(big.Rat).SetFloat64(float64(rv))
+	case float64:
+		return new(big.Rat).SetFloat64(rv)
+	}
+	return v
+}
+
+// bigToNative narrows a big-mode value back to int64/float64 so it can be
+// passed to a registered func, which deals in native Go types.
+func bigToNative(v interface{}) interface{} {
+	switch rv := normalizeBig(v).(type) {
+	case *big.Int:
+		return rv.Int64()
+	case *big.Rat:
+		f, _ := rv.Float64()
+		return f
+	default:
+		return rv
+	}
+}
+
+func boolCastBig(v interface{}) bool {
+	switch rv := normalizeBig(v).(type) {
+	case nil:
+		return false
+	case bool:
+		return rv
+	case string:
+		return rv != ""
+	case *big.Int:
+		return rv.Sign() != 0
+	case *big.Rat:
+		return rv.Sign() != 0
+	default:
+		panic(fmt.Errorf("unsupported boolean value"))
+	}
+}
+
+func bigIntCast(v interface{}) *big.Int {
+	switch rv := normalizeBig(v).(type) {
+	case nil:
+		return big.NewInt(0)
+	case *big.Int:
+		return rv
+	case *big.Rat:
+		return new(big.Int).Quo(rv.Num(), rv.Denom())
+	case bool:
+		if rv {
+			return big.NewInt(1)
+		}
+		return big.NewInt(0)
+	default:
+		panic(fmt.Errorf("not castable to a big.Int"))
+	}
+}
+
+func bigRatCast(v interface{}) *big.Rat {
+	switch rv := normalizeBig(v).(type) {
+	case nil:
+		return new(big.Rat)
+	case *big.Rat:
+		return rv
+	case *big.Int:
+		return new(big.Rat).SetInt(rv)
+	case bool:
+		if rv {
+			return big.NewRat(1, 1)
+		}
+		return new(big.Rat)
+	default:
+		panic(fmt.Errorf("not castable to a big.Rat"))
+	}
+}
+
+// bigBinOp is binOp's bigMode counterpart: it mirrors the same coercion
+// order (bool first, then nil handling, then typed dispatch) but operates
+// on *big.Int / *big.Rat instead of int64 / float64.
+func bigBinOp(op token.Token, lhs, rhs interface{}) (interface{}, error) {
+	ll := normalizeBig(lhs)
+
+	if l, ok := ll.(bool); ok {
+		switch op {
+		case token.EQL:
+			return l == boolCastBig(rhs), nil
+		case token.NEQ:
+			return l != boolCastBig(rhs), nil
+		}
+		panic(fmt.Errorf("unsupported boolean operation"))
+	}
+
+	rr := normalizeBig(rhs)
+
+	if ll == nil {
+		switch op {
+		case token.EQL:
+			return ll == rr, nil
+		case token.NEQ:
+			return ll != rr, nil
+		}
+	}
+
+	if rr == nil {
+		switch op {
+		case token.EQL:
+			return ll == nil, nil
+		case token.NEQ:
+			return ll != nil, nil
+		}
+	}
+
+	switch l := ll.(type) {
+	case *big.Int:
+		if r, ok := rr.(*big.Rat); ok {
+			return bigRatOp(op, new(big.Rat).SetInt(l), r)
+		}
+		return bigIntOp(op, l, bigIntCast(rr))
+
+	case *big.Rat:
+		return bigRatOp(op, l, bigRatCast(rr))
+
+	case string:
+		r := stringCast(bigToNative(rr))
+		switch op {
+		case token.ADD:
+			return l + r, nil
+		case token.EQL:
+			return l == r, nil
+		case token.NEQ:
+			return l != r, nil
+		case token.LSS:
+			return l < r, nil
+		case token.GTR:
+			return l > r, nil
+		case token.LEQ:
+			return l <= r, nil
+		case token.GEQ:
+			return l >= r, nil
+		}
+
+	default:
+		if ll == nil {
+			return nil, nil
+		}
+		kind := reflect.TypeOf(ll).Kind()
+		if kind == reflect.Map {
+			return ll, nil
+		}
+		panic(fmt.Errorf("unsupported type %#v", ll))
+	}
+	panic(fmt.Errorf("unsupported expression %v %s %v", ll, op, rr))
+}
+
+func bigIntOp(op token.Token, l, r *big.Int) (interface{}, error) {
+	switch op {
+	case token.EQL:
+		return l.Cmp(r) == 0, nil
+	case token.NEQ:
+		return l.Cmp(r) != 0, nil
+	case token.LSS:
+		return l.Cmp(r) < 0, nil
+	case token.GTR:
+		return l.Cmp(r) > 0, nil
+	case token.LEQ:
+		return l.Cmp(r) <= 0, nil
+	case token.GEQ:
+		return l.Cmp(r) >= 0, nil
+
+	case token.ADD:
+		return new(big.Int).Add(l, r), nil
+	case token.SUB:
+		return new(big.Int).Sub(l, r), nil
+	case token.MUL:
+		return new(big.Int).Mul(l, r), nil
+	case token.QUO:
+		if r.Sign() == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return new(big.Int).Quo(l, r), nil
+	case token.REM:
+		if r.Sign() == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return new(big.Int).Rem(l, r), nil
+
+	case token.SHL, token.SHR:
+		if r.Sign() < 0 {
+			return nil, fmt.Errorf("negative shift count")
+		}
+		if !r.IsUint64() || r.BitLen() > 32 {
+			return nil, fmt.Errorf("shift count too large")
+		}
+		n := uint(r.Uint64())
+		if op == token.SHL {
+			return new(big.Int).Lsh(l, n), nil
+		}
+		return new(big.Int).Rsh(l, n), nil
+
+	case token.AND:
+		return new(big.Int).And(l, r), nil
+	case token.OR:
+		return new(big.Int).Or(l, r), nil
+	case token.XOR:
+		return new(big.Int).Xor(l, r), nil
+	case token.AND_NOT:
+		return new(big.Int).AndNot(l, r), nil
+	}
+	panic(fmt.Errorf("unsupported expression %v %s %v", l, op, r))
+}
+
+func bigRatOp(op token.Token, l, r *big.Rat) (interface{}, error) {
+	switch op {
+	case token.EQL:
+		return l.Cmp(r) == 0, nil
+	case token.NEQ:
+		return l.Cmp(r) != 0, nil
+	case token.LSS:
+		return l.Cmp(r) < 0, nil
+	case token.GTR:
+		return l.Cmp(r) > 0, nil
+	case token.LEQ:
+		return l.Cmp(r) <= 0, nil
+	case token.GEQ:
+		return l.Cmp(r) >= 0, nil
+
+	case token.ADD:
+		return new(big.Rat).Add(l, r), nil
+	case token.SUB:
+		return new(big.Rat).Sub(l, r), nil
+	case token.MUL:
+		return new(big.Rat).Mul(l, r), nil
+	case token.QUO:
+		if r.Sign() == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return new(big.Rat).Quo(l, r), nil
+	}
+	panic(fmt.Errorf("unsupported operator %s on float", op))
+}
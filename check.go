@@ -0,0 +1,329 @@
+package expr
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strings"
+)
+
+// Type is the static type of an expression operand, as used by
+// Expression.Check.
+type Type int
+
+const (
+	TypeAny Type = iota
+	TypeInt
+	TypeUint
+	TypeFloat
+	TypeString
+	TypeBool
+	TypeMap
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeInt:
+		return "int"
+	case TypeUint:
+		return "uint"
+	case TypeFloat:
+		return "float"
+	case TypeString:
+		return "string"
+	case TypeBool:
+		return "bool"
+	case TypeMap:
+		return "map"
+	default:
+		return "any"
+	}
+}
+
+// Check performs opt-in static type checking of the expression against
+// scope, a mapping of identifier name to its declared Type. It applies
+// coercion rules modelled on binOp's (string + any -> string, int + float
+// -> float, comparisons and &&/|| -> bool, and so on) so that unsupported
+// operand combinations are reported as an error, with a position pointing
+// into Expr, instead of only surfacing via a runtime panic from Eval.
+// Numeric promotion in Check does not depend on operand order, whereas
+// binOp converts the right operand to the left operand's type, so for
+// int + float Check reports float while Eval returns an int64.
+//
+// Identifiers missing from scope, and the results of selector expressions,
+// are treated as TypeAny and are not checked further. A function call's
+// result type is inferred from the Go return type of the resolved function
+// (see funcReturnType). Check only flags operand combinations it can prove
+// are invalid.
+func (e *Expression) Check(scope map[string]Type) error {
+	if e.Expr == "" {
+		return nil
+	}
+	fset := token.NewFileSet()
+	node, err := checkParse(fset, e.Expr)
+	if err != nil {
+		return err
+	}
+	_, err = checkType(fset, scope, e.funcs, node)
+	return err
+}
+
+// checkParse mirrors compileNode's ternary-splitting, but parses each
+// sub-expression with parser.ParseExprFrom against fset so that node
+// positions are real offsets into expr rather than relative to an
+// internal, throwaway file.
+//
+// Ternary operands are padded with leading spaces to their true offset in
+// expr before being parsed independently, so that positions inside them
+// remain correct without needing lower-level access to go/scanner.
+func checkParse(fset *token.FileSet, expr string) (ast.Node, error) {
+	if cond, x, y, ok := splitTernary(expr); ok {
+		c, err := checkParse(fset, cond)
+		if err != nil {
+			return nil, err
+		}
+		xe, err := checkParse(fset, pad(x, len(cond)+1))
+		if err != nil {
+			return nil, err
+		}
+		ye, err := checkParse(fset, pad(y, len(cond)+1+len(x)+1))
+		if err != nil {
+			return nil, err
+		}
+		return &condExpr{Cond: c, X: xe, Y: ye}, nil
+	}
+	return parser.ParseExprFrom(fset, "", expr, 0)
+}
+
+func pad(s string, offset int) string {
+	return strings.Repeat(" ", offset) + s
+}
+
+func checkErrorf(fset *token.FileSet, pos token.Pos, format string, args ...interface{}) error {
+	return fmt.Errorf("%s: %s", fset.Position(pos), fmt.Sprintf(format, args...))
+}
+
+// checkType computes node's result type, reporting an error for any operand
+// combination that eval would otherwise only reject via a runtime panic.
+func checkType(fset *token.FileSet, scope map[string]Type, funcs map[string]reflect.Value, node ast.Node) (Type, error) {
+	switch n := node.(type) {
+	case *condExpr:
+		ct, err := checkType(fset, scope, funcs, n.Cond)
+		if err != nil {
+			return TypeAny, err
+		}
+		if !boolish(ct) {
+			return TypeAny, checkErrorf(fset, n.Cond.Pos(), "ternary condition must be bool, got %s", ct)
+		}
+		xt, err := checkType(fset, scope, funcs, n.X)
+		if err != nil {
+			return TypeAny, err
+		}
+		yt, err := checkType(fset, scope, funcs, n.Y)
+		if err != nil {
+			return TypeAny, err
+		}
+		if xt != yt {
+			return TypeAny, nil
+		}
+		return xt, nil
+
+	case *ast.ParenExpr:
+		return checkType(fset, scope, funcs, n.X)
+
+	case *ast.BasicLit:
+		switch n.Kind {
+		case token.STRING:
+			return TypeString, nil
+		case token.INT:
+			return TypeInt, nil
+		case token.FLOAT:
+			return TypeFloat, nil
+		}
+		return TypeAny, checkErrorf(fset, n.Pos(), "unsupported literal kind %s", n.Kind)
+
+	case *ast.UnaryExpr:
+		if n.Op != token.NOT {
+			return TypeAny, checkErrorf(fset, n.Pos(), "unsupported unary operator %s", n.Op)
+		}
+		xt, err := checkType(fset, scope, funcs, n.X)
+		if err != nil {
+			return TypeAny, err
+		}
+		if !boolish(xt) {
+			return TypeAny, checkErrorf(fset, n.X.Pos(), "operator ! requires bool, got %s", xt)
+		}
+		return TypeBool, nil
+
+	case *ast.Ident:
+		if n.Name == "true" || n.Name == "false" {
+			return TypeBool, nil
+		}
+		if t, ok := scope[n.Name]; ok {
+			return t, nil
+		}
+		return TypeAny, nil
+
+	case *ast.SelectorExpr:
+		path, ok := selectorPath(n)
+		if !ok {
+			return TypeAny, checkErrorf(fset, n.Pos(), "unsupported selector expression")
+		}
+		if base, ok := scope[path[0]]; ok && !mapish(base) {
+			return TypeAny, checkErrorf(fset, n.Pos(), "cannot select field %q on %s", path[len(path)-1], base)
+		}
+		return TypeAny, nil
+
+	case *ast.CallExpr:
+		id, ok := n.Fun.(*ast.Ident)
+		if !ok {
+			return TypeAny, checkErrorf(fset, n.Pos(), "unsupported call expression")
+		}
+		fn, ok := funcs[id.Name]
+		if !ok {
+			fn, ok = defaultFuncs[id.Name]
+		}
+		if !ok {
+			return TypeAny, checkErrorf(fset, n.Pos(), "unknown function %q", id.Name)
+		}
+		for _, a := range n.Args {
+			if _, err := checkType(fset, scope, funcs, a); err != nil {
+				return TypeAny, err
+			}
+		}
+		return funcReturnType(fn), nil
+
+	case *ast.BinaryExpr:
+		lt, err := checkType(fset, scope, funcs, n.X)
+		if err != nil {
+			return TypeAny, err
+		}
+		rt, err := checkType(fset, scope, funcs, n.Y)
+		if err != nil {
+			return TypeAny, err
+		}
+		return checkBinary(fset, n.OpPos, n.Op, lt, rt)
+	}
+	return TypeAny, checkErrorf(fset, node.Pos(), "unsupported expression node %#v", node)
+}
+
+func boolish(t Type) bool { return t == TypeBool || t == TypeAny }
+func mapish(t Type) bool  { return t == TypeMap || t == TypeAny }
+func integerish(t Type) bool {
+	return t == TypeInt || t == TypeUint || t == TypeAny
+}
+
+// checkBinary computes the result type of a binary operator applied to lt
+// and rt, following the coercions binOp applies at runtime. && and ||, which
+// binOp never sees, only require their operands be bool-ish, not a common
+// type.
+func checkBinary(fset *token.FileSet, pos token.Pos, op token.Token, lt, rt Type) (Type, error) {
+	switch op {
+	case token.LAND, token.LOR:
+		if !boolish(lt) {
+			return TypeAny, checkErrorf(fset, pos, "operator %s requires bool operands, got %s", op, lt)
+		}
+		if !boolish(rt) {
+			return TypeAny, checkErrorf(fset, pos, "operator %s requires bool operands, got %s", op, rt)
+		}
+		return TypeBool, nil
+
+	case token.EQL, token.NEQ, token.LSS, token.GTR, token.LEQ, token.GEQ:
+		return TypeBool, nil
+
+	case token.SHL, token.SHR:
+		if !integerish(lt) {
+			return TypeAny, checkErrorf(fset, pos, "operator %s requires an integer left operand, got %s", op, lt)
+		}
+		if !integerish(rt) {
+			return TypeAny, checkErrorf(fset, pos, "operator %s requires an integer shift count, got %s", op, rt)
+		}
+		if lt == TypeAny {
+			return rt, nil
+		}
+		return lt, nil
+
+	case token.AND, token.OR, token.XOR, token.AND_NOT:
+		if !integerish(lt) {
+			return TypeAny, checkErrorf(fset, pos, "operator %s requires integer operands, got %s", op, lt)
+		}
+		if !integerish(rt) {
+			return TypeAny, checkErrorf(fset, pos, "operator %s requires integer operands, got %s", op, rt)
+		}
+		return combineNumeric(lt, rt), nil
+
+	case token.ADD, token.SUB, token.MUL, token.QUO, token.REM:
+		return checkArith(fset, pos, op, lt, rt)
+	}
+	return TypeAny, checkErrorf(fset, pos, "unsupported binary operator %s", op)
+}
+
+// checkArith computes the result type of +, -, *, / and %, modelled on
+// binOp's int64/uint64/string/float64 branches. A string on either side
+// yields TypeString, although at runtime only a string left operand
+// concatenates; int + string fails in Eval.
+func checkArith(fset *token.FileSet, pos token.Pos, op token.Token, lt, rt Type) (Type, error) {
+	if lt == TypeAny || rt == TypeAny {
+		return TypeAny, nil
+	}
+	if lt == TypeString || rt == TypeString {
+		if op != token.ADD {
+			return TypeAny, checkErrorf(fset, pos, "operator %s not supported on string", op)
+		}
+		return TypeString, nil
+	}
+	if lt == TypeBool || rt == TypeBool {
+		return TypeAny, checkErrorf(fset, pos, "operator %s not supported on bool", op)
+	}
+	if lt == TypeMap || rt == TypeMap {
+		return TypeAny, checkErrorf(fset, pos, "operator %s not supported on map", op)
+	}
+	return combineNumeric(lt, rt), nil
+}
+
+// combineNumeric applies a "largest super type wins" promotion regardless of
+// operand order: float beats int beats uint. At runtime binOp instead casts
+// the right operand to the left operand's type.
+func combineNumeric(lt, rt Type) Type {
+	if lt == TypeAny {
+		return rt
+	}
+	if rt == TypeAny {
+		return lt
+	}
+	if lt == TypeFloat || rt == TypeFloat {
+		return TypeFloat
+	}
+	if lt == TypeInt || rt == TypeInt {
+		return TypeInt
+	}
+	return TypeUint
+}
+
+// funcReturnType infers a function's result Type from its single return
+// value's reflect.Kind. This applies equally to default builtins and funcs
+// registered with RegisterFunc.
+func funcReturnType(fn reflect.Value) Type {
+	ft := fn.Type()
+	if ft.NumOut() != 1 {
+		return TypeAny
+	}
+	switch ft.Out(0).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return TypeInt
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return TypeUint
+	case reflect.Float32, reflect.Float64:
+		return TypeFloat
+	case reflect.String:
+		return TypeString
+	case reflect.Bool:
+		return TypeBool
+	case reflect.Map:
+		return TypeMap
+	default:
+		return TypeAny
+	}
+}
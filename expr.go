@@ -3,11 +3,10 @@
 //
 // eg.
 //
-// 		expr := MustCompile("a + 1 > 2")
-// 		expr.Bool(V{"a": 0}) == false
-// 		expr.Bool(V{"a": 1}) == false
-// 		expr.Bool(V{"a": 2}) == true
-//
+//	expr := MustCompile("a + 1 > 2")
+//	expr.Bool(V{"a": 0}) == false
+//	expr.Bool(V{"a": 1}) == false
+//	expr.Bool(V{"a": 2}) == true
 package expr
 
 import (
@@ -16,7 +15,9 @@ import (
 	"go/parser"
 	"go/token"
 	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
 )
 
 // V is a (possibly nested) map of name:value pairs that are evaluated against
@@ -24,10 +25,23 @@ import (
 type V map[string]interface{}
 
 // Expression is a expression that is compiled and ready for evaluation.
+//
+// Evaluation runs a small bytecode VM rather than walking the parsed
+// go/ast tree directly: compile() emits code once, against parallel
+// consts/idents/selectors/calls slices indexed by small ints, so repeated
+// Eval calls avoid re-walking the tree and the reflection cost of
+// interpreting it.
 type Expression struct {
-	ast   *ast.Expr
 	Expr  string
 	Terms []string // Collected terms from the expression. May contain duplicates.
+	funcs map[string]reflect.Value
+	node  ast.Node // parsed tree, kept around so RegisterFunc can re-derive Terms
+
+	code      []instr
+	consts    []interface{}
+	idents    []string
+	selectors [][]string
+	calls     []callInfo
 }
 
 func MustCompile(expr string) *Expression {
@@ -42,7 +56,11 @@ func MustCompile(expr string) *Expression {
 // value. An empty expression always evaluates to true.
 //
 // An expression is any syntactically valid Go expression (excluding the
-// subscript operator []). Nested Values can be traversed with A.B.C.
+// subscript operator []), plus the Go-like ternary conditional
+// "cond ? trueExpr : falseExpr", which go/parser does not itself support.
+// Nested values can be traversed with A.B.C, which works against nested V
+// maps as well as structs, pointers to structs and map[string]T values
+// stored inside V.
 func Compile(expr string) (*Expression, error) {
 	e := &Expression{
 		Expr: expr,
@@ -62,15 +80,149 @@ func (e *Expression) compile() error {
 	if e.Expr == "" {
 		return nil
 	}
-	ast, err := parser.ParseExpr(e.Expr)
+	node, err := compileNode(e.Expr)
 	if err != nil {
 		return err
 	}
-	e.ast = &ast
-	index(ast, &e.Terms)
+	e.node = node
+	index(node, &e.Terms, e.funcs)
+	c := &compiler{}
+	c.compile(node)
+	c.emit(opReturn, 0)
+	e.code = c.code
+	e.consts = c.consts
+	e.idents = c.idents
+	e.selectors = c.selectors
+	e.calls = c.calls
 	return nil
 }
 
+// condExpr represents a ternary conditional "Cond ? X : Y". go/parser has no
+// notion of "?:", so these are recognised and split out by splitTernary
+// before the remaining sub-expressions are handed to parser.ParseExpr. It
+// only needs to satisfy ast.Node (not ast.Expr, whose marker method is
+// private to the ast package), since compiler.compile and index work in
+// terms of ast.Node.
+type condExpr struct {
+	Cond, X, Y ast.Node
+}
+
+func (c *condExpr) Pos() token.Pos { return c.Cond.Pos() }
+func (c *condExpr) End() token.Pos { return c.Y.End() }
+
+// compileNode parses expr, recognising the ternary conditional
+// "cond ? x : y" at the top level and recursing into each branch so that
+// ternaries may be nested.
+func compileNode(expr string) (ast.Node, error) {
+	if cond, x, y, ok := splitTernary(expr); ok {
+		c, err := compileNode(cond)
+		if err != nil {
+			return nil, err
+		}
+		xe, err := compileNode(x)
+		if err != nil {
+			return nil, err
+		}
+		ye, err := compileNode(y)
+		if err != nil {
+			return nil, err
+		}
+		return &condExpr{Cond: c, X: xe, Y: ye}, nil
+	}
+	e, err := parser.ParseExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// splitTernary finds the top-level "?" and its matching ":" in expr (ie. not
+// nested inside (), [], {} or a string literal) and splits expr into its
+// cond, true and false branches. Ternaries are right-associative, so the
+// matching ":" is found by tracking nested "?"/":" pairs, allowing
+// "a ? b : c ? d : e" to parse as "a ? b : (c ? d : e)".
+//
+// Backslash only escapes the closing quote inside a "..." literal. A
+// `` ` ``-quoted raw string literal gives backslash no special meaning in
+// Go, so one ending in an odd number of backslashes must still close on
+// the next backtick rather than have that backtick treated as escaped.
+func splitTernary(expr string) (cond, x, y string, ok bool) {
+	qpos := -1
+	depth := 0
+	var quote byte
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		if quote != 0 {
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'', '`':
+			quote = c
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case '?':
+			if depth == 0 {
+				qpos = i
+			}
+		}
+		if qpos != -1 {
+			break
+		}
+	}
+	if qpos == -1 {
+		return "", "", "", false
+	}
+
+	depth = 0
+	nest := 1
+	quote = 0
+	cpos := -1
+	for i := qpos + 1; i < len(expr); i++ {
+		c := expr[i]
+		if quote != 0 {
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'', '`':
+			quote = c
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case '?':
+			if depth == 0 {
+				nest++
+			}
+		case ':':
+			if depth == 0 {
+				nest--
+				if nest == 0 {
+					cpos = i
+				}
+			}
+		}
+		if cpos != -1 {
+			break
+		}
+	}
+	if cpos == -1 {
+		return "", "", "", false
+	}
+	return expr[:qpos], expr[qpos+1 : cpos], expr[cpos+1:], true
+}
+
 // Bool evaluates the expression against a value and returns its "truthiness".
 // The empty expression evaluates to true. Any errors will evaluate to false.
 func (e *Expression) Bool(value V) bool {
@@ -99,10 +251,72 @@ func (e *Expression) Eval(value V) (v interface{}, err error) {
 			err = e.(error)
 		}
 	}()
-	v = eval(value, *e.ast)
+	v = run(e, value)
 	return
 }
 
+// Int evaluates the expression and coerces the result to an int64.
+func (e *Expression) Int(value V) (n int64, err error) {
+	v, err := e.Eval(value)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	return intCast(v), nil
+}
+
+// Float evaluates the expression and coerces the result to a float64.
+func (e *Expression) Float(value V) (n float64, err error) {
+	v, err := e.Eval(value)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = r.(error)
+		}
+	}()
+	return floatCast(v), nil
+}
+
+// RegisterFunc registers fn under name for use in function calls within
+// this expression, in addition to the package's default functions (len,
+// lower, upper, contains, hasPrefix, hasSuffix, matches, int, float, string
+// and coalesce).
+//
+// fn is called via reflection: arguments are coerced to its parameter types
+// the same way eval coerces binary operands, and its return value (it must
+// return zero or one values) is normalized like any other evaluated value.
+//
+// Terms is re-derived after registering, since a call to name may already
+// have been indexed as a plain identifier reference by Compile, before fn
+// was known to resolve it.
+func (e *Expression) RegisterFunc(name string, fn interface{}) {
+	if e.funcs == nil {
+		e.funcs = map[string]reflect.Value{}
+	}
+	e.funcs[name] = reflect.ValueOf(fn)
+	if e.node != nil {
+		e.Terms = nil
+		index(e.node, &e.Terms, e.funcs)
+	}
+}
+
+// Str evaluates the expression and coerces the result to a string. It is
+// named Str, rather than String, because Expression already implements
+// fmt.Stringer.
+func (e *Expression) Str(value V) (string, error) {
+	v, err := e.Eval(value)
+	if err != nil {
+		return "", err
+	}
+	return stringCast(v), nil
+}
+
 // Normalize all int values to int64, all unsigned int values to uint64 and
 // all float values to float64.
 func normalize(v interface{}) interface{} {
@@ -139,13 +353,37 @@ func normalize(v interface{}) interface{} {
 	return v
 }
 
-func index(expr ast.Node, out *[]string) {
+// index collects the identifiers referenced by expr into out, skipping any
+// name that resolves to a function - either a default builtin or one of
+// funcs, the Expression's own RegisterFunc-ed functions - so a call like
+// len(s) or double(I) only contributes "s" or "I" to Terms, not the
+// function name itself.
+func index(expr ast.Node, out *[]string, funcs map[string]reflect.Value) {
 	switch n := expr.(type) {
 	case *ast.BinaryExpr:
-		index(n.X, out)
-		index(n.Y, out)
+		index(n.X, out, funcs)
+		index(n.Y, out, funcs)
 	case *ast.ParenExpr:
-		index(n.X, out)
+		index(n.X, out, funcs)
+	case *condExpr:
+		index(n.Cond, out, funcs)
+		index(n.X, out, funcs)
+		index(n.Y, out, funcs)
+	case *ast.CallExpr:
+		known := false
+		if id, ok := n.Fun.(*ast.Ident); ok {
+			if _, ok := defaultFuncs[id.Name]; ok {
+				known = true
+			} else if _, ok := funcs[id.Name]; ok {
+				known = true
+			}
+		}
+		if !known {
+			index(n.Fun, out, funcs)
+		}
+		for _, arg := range n.Args {
+			index(arg, out, funcs)
+		}
 	case *ast.Ident:
 		if n.Name != "nil" && n.Name != "true" && n.Name != "false" {
 			*out = append(*out, n.Name)
@@ -153,246 +391,88 @@ func index(expr ast.Node, out *[]string) {
 	}
 }
 
-func eval(value V, expr ast.Node) interface{} {
-	switch n := expr.(type) {
-	case *ast.BinaryExpr:
-		ll := normalize(eval(value, n.X))
+// defaultFuncs are available to every Expression, in addition to any
+// registered with Expression.RegisterFunc.
+var defaultFuncs = map[string]reflect.Value{
+	"len":       reflect.ValueOf(builtinLen),
+	"lower":     reflect.ValueOf(strings.ToLower),
+	"upper":     reflect.ValueOf(strings.ToUpper),
+	"contains":  reflect.ValueOf(builtinContains),
+	"hasPrefix": reflect.ValueOf(strings.HasPrefix),
+	"hasSuffix": reflect.ValueOf(strings.HasSuffix),
+	"matches":   reflect.ValueOf(builtinMatches),
+	"int":       reflect.ValueOf(builtinInt),
+	"float":     reflect.ValueOf(builtinFloat),
+	"string":    reflect.ValueOf(func(v interface{}) string { return stringCast(v) }),
+	"coalesce":  reflect.ValueOf(builtinCoalesce),
+}
 
-		switch n.Op {
-		case token.LAND:
-			return boolCast(ll) && boolCast(eval(value, n.Y))
-		case token.LOR:
-			return boolCast(ll) || boolCast(eval(value, n.Y))
-		}
+func builtinLen(v interface{}) int64 {
+	if v == nil {
+		return 0
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map, reflect.Chan:
+		return int64(rv.Len())
+	}
+	panic(fmt.Errorf("len: unsupported type %T", v))
+}
 
-		// Bool is first, to support short-circuit evaluation.
-		if l, ok := ll.(bool); ok {
-			switch n.Op {
-			case token.EQL:
-				r := boolCast(eval(value, n.Y))
-				return l == r
-			case token.NEQ:
-				r := boolCast(eval(value, n.Y))
-				return l != r
+func builtinContains(haystack, needle interface{}) bool {
+	if s, ok := haystack.(string); ok {
+		return strings.Contains(s, stringCast(needle))
+	}
+	rv := reflect.ValueOf(haystack)
+	if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+		n := stringCast(needle)
+		for i := 0; i < rv.Len(); i++ {
+			if stringCast(rv.Index(i).Interface()) == n {
+				return true
 			}
-			panic(fmt.Errorf("unsupported boolean operation"))
 		}
+		return false
+	}
+	panic(fmt.Errorf("contains: unsupported type %T", haystack))
+}
 
-		rr := normalize(eval(value, n.Y))
-
-		if ll == nil {
-			switch n.Op {
-			case token.EQL:
-				return ll == rr
-			case token.NEQ:
-				return ll != rr
-			}
+func builtinInt(v interface{}) int64 {
+	if s, ok := v.(string); ok {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			panic(err)
 		}
+		return n
+	}
+	return intCast(v)
+}
 
-		if rr == nil {
-			switch n.Op {
-			case token.EQL:
-				return ll == nil
-			case token.NEQ:
-				return ll != nil
-			}
-		} else {
-			rr = normalize(rr)
+func builtinFloat(v interface{}) float64 {
+	if s, ok := v.(string); ok {
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			panic(err)
 		}
+		return n
+	}
+	return floatCast(v)
+}
 
-		switch l := ll.(type) {
-		case int64:
-			r := intCast(rr)
-			switch n.Op {
-			case token.EQL:
-				return l == r
-			case token.NEQ:
-				return l != r
-			case token.LSS:
-				return l < r
-			case token.GTR:
-				return l > r
-			case token.LEQ:
-				return l <= r
-			case token.GEQ:
-				return l >= r
-
-			case token.ADD:
-				return l + r
-			case token.SUB:
-				return l - r
-			case token.MUL:
-				return l * r
-			case token.QUO:
-				return l / r
-			case token.REM:
-				return l % r
-			case token.SHL:
-				if r < 0 {
-					panic(fmt.Errorf("negative shift count"))
-				}
-				return l << uint64(r)
-			case token.SHR:
-				if r < 0 {
-					panic(fmt.Errorf("negative shift count"))
-				}
-				return l >> uint64(r)
-
-			case token.AND:
-				return l & r
-			case token.OR:
-				return l | r
-			case token.XOR:
-				return l ^ r
-			case token.AND_NOT:
-				return l &^ r
-			}
-
-		case uint64:
-			r := uintCast(rr)
-			switch n.Op {
-			case token.EQL:
-				return l == r
-			case token.NEQ:
-				return l != r
-			case token.LSS:
-				return l < r
-			case token.GTR:
-				return l > r
-			case token.LEQ:
-				return l <= r
-			case token.GEQ:
-				return l >= r
-
-			case token.ADD:
-				return l + r
-			case token.SUB:
-				return l - r
-			case token.MUL:
-				return l * r
-			case token.QUO:
-				return l / r
-			case token.REM:
-				return l % r
-			case token.SHL:
-				return l << r
-			case token.SHR:
-				return l >> r
-
-			case token.AND:
-				return l & r
-			case token.OR:
-				return l | r
-			case token.XOR:
-				return l ^ r
-			case token.AND_NOT:
-				return l &^ r
-			}
+func builtinMatches(s, pattern string) bool {
+	matched, err := regexp.MatchString(pattern, s)
+	if err != nil {
+		panic(err)
+	}
+	return matched
+}
 
-		case string:
-			r := stringCast(rr)
-			switch n.Op {
-			case token.ADD:
-				return l + r
-
-			case token.EQL:
-				return l == r
-			case token.NEQ:
-				return l != r
-			case token.LSS:
-				return l < r
-			case token.GTR:
-				return l > r
-			case token.LEQ:
-				return l <= r
-			case token.GEQ:
-				return l >= r
-			}
-		case float64:
-			r := floatCast(rr)
-			switch n.Op {
-			case token.ADD:
-				return l + r
-			case token.SUB:
-				return l - r
-			case token.MUL:
-				return l * r
-			case token.QUO:
-				return l / r
-
-			case token.EQL:
-				return l == r
-			case token.NEQ:
-				return l != r
-			case token.LSS:
-				return l < r
-			case token.GTR:
-				return l > r
-			case token.LEQ:
-				return l <= r
-			case token.GEQ:
-				return l >= r
-			}
-		default:
-			if ll == nil {
-				return nil
-			}
-			kind := reflect.TypeOf(ll).Kind()
-			if kind == reflect.Map {
-				return ll
-			}
-			panic(fmt.Errorf("unsupported type %#v", ll))
+func builtinCoalesce(args ...interface{}) interface{} {
+	for _, a := range args {
+		if a != nil {
+			return a
 		}
-		panic(fmt.Errorf("unsupported expression %v %s %v", ll, n.Op, rr))
-	case *ast.BasicLit:
-		switch n.Kind {
-		case token.STRING:
-			s, err := strconv.Unquote(n.Value)
-			if err != nil {
-				panic(err.Error())
-			}
-			return s
-		case token.INT:
-			nu, err := strconv.ParseInt(n.Value, 10, 64)
-			if err != nil {
-				panic(err.Error())
-			}
-			return nu
-		case token.FLOAT:
-			n, err := strconv.ParseFloat(n.Value, 64)
-			if err != nil {
-				panic(err.Error())
-			}
-			return n
-		}
-		panic(fmt.Errorf("unsupported type"))
-	case *ast.ParenExpr:
-		return eval(value, n.X)
-	case *ast.UnaryExpr:
-		if n.Op == token.NOT {
-			return !boolCast(eval(value, n.X))
-		}
-		panic(fmt.Errorf("unsupported unary operator %s", n.Op))
-	case *ast.Ident:
-		if v, ok := value[n.Name]; ok {
-			return normalize(v)
-		}
-		if n.Name == "true" {
-			return true
-		} else if n.Name == "false" {
-			return false
-		}
-		return nil
-	case *ast.SelectorExpr:
-		v := eval(value, n.X)
-		if m, ok := v.(V); ok {
-			if v, ok := m[n.Sel.Name]; ok {
-				return v
-			}
-		}
-		panic(fmt.Errorf("unknown attribute \"%s\" on %#v", n.Sel.Name, v))
 	}
-	panic(fmt.Errorf("unsupported expression node %#v", expr))
+	return nil
 }
 
 func intCast(v interface{}) int64 {
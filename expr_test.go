@@ -1,6 +1,7 @@
 package expr
 
 import (
+	"math/big"
 	"testing"
 
 	"github.com/stretchrcom/testify/assert"
@@ -106,6 +107,235 @@ func BenchmarkEval(t *testing.B) {
 	}
 }
 
+func TestTernary(t *testing.T) {
+	n, err := MustCompile(`I == 5 ? "yes" : "no"`).Eval(V{"I": 5})
+	assert.NoError(t, err)
+	assert.Equal(t, "yes", n)
+	n, err = MustCompile(`I == 5 ? "yes" : "no"`).Eval(V{"I": 3})
+	assert.NoError(t, err)
+	assert.Equal(t, "no", n)
+}
+
+func TestTernaryNested(t *testing.T) {
+	e := MustCompile(`I == 1 ? "one" : I == 2 ? "two" : "other"`)
+	n, err := e.Eval(V{"I": 2})
+	assert.NoError(t, err)
+	assert.Equal(t, "two", n)
+}
+
+func TestTernaryShortCircuit(t *testing.T) {
+	// Only the selected branch is evaluated, so a reference to a missing key
+	// on the untaken branch must not cause an error.
+	n, err := MustCompile(`true ? 1 : Missing.Field`).Eval(V{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+}
+
+func TestTernaryRawStringBackslash(t *testing.T) {
+	// Raw strings give backslash no special meaning, unlike "..." literals,
+	// so an odd number of backslashes before the closing backtick must not
+	// desync the scanner and hide a real top-level "?" later in expr.
+	cond, x, y, ok := splitTernary("`\\` == \"x\" ? 1 : 2")
+	assert.True(t, ok)
+	assert.Equal(t, "`\\` == \"x\" ", cond)
+	assert.Equal(t, " 1 ", x)
+	assert.Equal(t, " 2", y)
+}
+
+func TestTypedEval(t *testing.T) {
+	value := V{"I": 5, "F": 1.5, "S": "hi"}
+	i, err := MustCompile("I").Int(value)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), i)
+
+	f, err := MustCompile("F").Float(value)
+	assert.NoError(t, err)
+	assert.Equal(t, 1.5, f)
+
+	s, err := MustCompile("S").Str(value)
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", s)
+}
+
+func TestCallBuiltins(t *testing.T) {
+	assert.True(t, MustCompile(`len(s) > 0`).Bool(V{"s": "hello"}))
+	assert.True(t, MustCompile(`lower(name) == "bob"`).Bool(V{"name": "BOB"}))
+	assert.True(t, MustCompile(`upper(name) == "BOB"`).Bool(V{"name": "bob"}))
+	assert.True(t, MustCompile(`contains(tags, "x")`).Bool(V{"tags": []string{"x", "y"}}))
+	assert.True(t, MustCompile(`hasPrefix(s, "he")`).Bool(V{"s": "hello"}))
+	assert.True(t, MustCompile(`hasSuffix(s, "lo")`).Bool(V{"s": "hello"}))
+	assert.True(t, MustCompile(`matches(s, "^h.*o$")`).Bool(V{"s": "hello"}))
+	assert.True(t, MustCompile(`coalesce(a, b) == "b"`).Bool(V{"b": "b"}))
+
+	n, err := MustCompile(`int("42") + 1`).Eval(V{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(43), n)
+}
+
+func TestCallWrongArgCount(t *testing.T) {
+	_, err := MustCompile(`hasPrefix(s)`).Eval(V{"s": "hi"})
+	assert.Error(t, err)
+}
+
+func TestRegisterFunc(t *testing.T) {
+	e := MustCompile(`double(I) == 10`)
+	e.RegisterFunc("double", func(n int64) int64 { return n * 2 })
+	assert.True(t, e.Bool(V{"I": 5}))
+}
+
+func TestRegisterFuncTerms(t *testing.T) {
+	e := MustCompile(`double(I) == 10`)
+	e.RegisterFunc("double", func(n int64) int64 { return n * 2 })
+	assert.Equal(t, []string{"I"}, e.Terms)
+}
+
+func TestCallTerms(t *testing.T) {
+	e := MustCompile(`len(name) > 0`)
+	assert.Equal(t, []string{"name"}, e.Terms)
+}
+
+func TestCheckOK(t *testing.T) {
+	e := MustCompile(`I == 5 && S == "ok"`)
+	assert.NoError(t, e.Check(map[string]Type{"I": TypeInt, "S": TypeString}))
+}
+
+func TestCheckTypeMismatch(t *testing.T) {
+	e := MustCompile(`S << 2`)
+	err := e.Check(map[string]Type{"S": TypeString})
+	assert.Error(t, err)
+}
+
+func TestCheckUnknownFunc(t *testing.T) {
+	e := MustCompile(`bogus(I)`)
+	err := e.Check(map[string]Type{"I": TypeInt})
+	assert.Error(t, err)
+}
+
+func TestCheckTernary(t *testing.T) {
+	e := MustCompile(`I == 5 ? "yes" : "no"`)
+	assert.NoError(t, e.Check(map[string]Type{"I": TypeInt}))
+}
+
+func TestCheckAnyPropagates(t *testing.T) {
+	e := MustCompile(`Unbound + 1`)
+	assert.NoError(t, e.Check(nil))
+}
+
+func TestEvalBigArithmetic(t *testing.T) {
+	huge, ok := new(big.Int).SetString("123456789012345678901234567890", 10)
+	assert.True(t, ok)
+	n, err := MustCompile("A * B").EvalBig(V{"A": huge, "B": int64(2)})
+	assert.NoError(t, err)
+	got, ok := n.(*big.Int)
+	assert.True(t, ok)
+	want, _ := new(big.Int).SetString("246913578024691357802469135780", 10)
+	assert.Equal(t, 0, got.Cmp(want))
+}
+
+func TestEvalBigDivideByZero(t *testing.T) {
+	_, err := MustCompile("A / B").EvalBig(V{"A": int64(1), "B": int64(0)})
+	assert.Error(t, err)
+}
+
+func TestEvalBigFloat(t *testing.T) {
+	n, err := MustCompile("A + B").EvalBig(V{"A": 0.5, "B": 0.25})
+	assert.NoError(t, err)
+	got, ok := n.(*big.Rat)
+	assert.True(t, ok)
+	assert.Equal(t, 0, got.Cmp(big.NewRat(3, 4)))
+}
+
+func TestEvalBigLiteralOverflow(t *testing.T) {
+	e, err := CompileBig("123456789012345678901234567890 + 1")
+	assert.NoError(t, err)
+	n, err := e.EvalBig(V{})
+	assert.NoError(t, err)
+	got, ok := n.(*big.Int)
+	assert.True(t, ok)
+	want, _ := new(big.Int).SetString("123456789012345678901234567891", 10)
+	assert.Equal(t, 0, got.Cmp(want))
+}
+
+func TestEvalBigLiteralExactDecimal(t *testing.T) {
+	e, err := CompileBig("0.1 + 0.2")
+	assert.NoError(t, err)
+	n, err := e.EvalBig(V{})
+	assert.NoError(t, err)
+	got, ok := n.(*big.Rat)
+	assert.True(t, ok)
+	assert.Equal(t, 0, got.Cmp(big.NewRat(3, 10)))
+}
+
+type address struct {
+	City string
+}
+
+type person struct {
+	address
+	Name  string
+	Alias string `expr:"nickname"`
+	Home  *address
+}
+
+func (p person) Greeting() string {
+	return "hi " + p.Name
+}
+
+func TestSelectorStruct(t *testing.T) {
+	p := person{Name: "Bob", address: address{City: "NYC"}}
+	assert.True(t, MustCompile(`P.Name == "Bob"`).Bool(V{"P": p}))
+	assert.True(t, MustCompile(`P.City == "NYC"`).Bool(V{"P": p}))
+}
+
+func TestSelectorStructPointer(t *testing.T) {
+	p := &person{Name: "Bob", Home: &address{City: "LA"}}
+	assert.True(t, MustCompile(`P.Home.City == "LA"`).Bool(V{"P": p}))
+}
+
+func TestSelectorNilPointer(t *testing.T) {
+	p := &person{Name: "Bob"}
+	assert.True(t, MustCompile(`P.Home == nil`).Bool(V{"P": p}))
+	assert.True(t, MustCompile(`P.Home.City == nil`).Bool(V{"P": p}))
+}
+
+func TestSelectorTag(t *testing.T) {
+	p := person{Alias: "bobby"}
+	assert.True(t, MustCompile(`P.nickname == "bobby"`).Bool(V{"P": p}))
+}
+
+func TestSelectorMethod(t *testing.T) {
+	p := person{Name: "Bob"}
+	assert.True(t, MustCompile(`P.Greeting == "hi Bob"`).Bool(V{"P": p}))
+}
+
+func TestSelectorStringMap(t *testing.T) {
+	m := map[string]string{"City": "NYC"}
+	assert.True(t, MustCompile(`P.City == "NYC"`).Bool(V{"P": m}))
+}
+
+type shadowed struct {
+	Alias string `expr:"Greeting"`
+}
+
+func (shadowed) Greeting() string {
+	return "method"
+}
+
+func TestSelectorTagBeatsMethod(t *testing.T) {
+	s := shadowed{Alias: "field"}
+	assert.True(t, MustCompile(`P.Greeting == "field"`).Bool(V{"P": s}))
+}
+
+type selfNode struct {
+	*selfNode
+	Value string
+}
+
+func TestSelectorEmbeddedCycle(t *testing.T) {
+	p := &selfNode{Value: "x"}
+	assert.False(t, MustCompile(`P.nickname == "y"`).Bool(V{"P": p}))
+}
+
 func TestStringCast(t *testing.T) {
 	assert.Equal(t, "10", stringCast(int64(10)))
 	assert.Equal(t, "10.5", stringCast(float64(10.5)))
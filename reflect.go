@@ -0,0 +1,159 @@
+package expr
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// resolveField resolves name against cur, the previous element of a
+// selector path. cur is usually a nested V map, but may also be an
+// arbitrary Go struct, a pointer to one, or a map[string]T passed as a
+// value inside V - this is what lets "Foo.Bar.Baz" work against real
+// application data structures instead of requiring callers to shred
+// everything into V first.
+//
+// A struct field is matched by name (honouring Go's usual promotion of
+// embedded fields) or by an `expr:"name"` tag; failing that, an exported,
+// nullary method is tried. A nil cur, or a nil pointer anywhere in the
+// chain, resolves to nil rather than panicking, so existing "X == nil"
+// idioms keep working.
+func resolveField(cur interface{}, name string) interface{} {
+	if cur == nil {
+		return nil
+	}
+	if m, ok := cur.(V); ok {
+		return m[name]
+	}
+
+	orig := reflect.ValueOf(cur)
+	if orig.Kind() == reflect.Ptr && orig.IsNil() {
+		return nil
+	}
+
+	rv := orig
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			panic(fmt.Errorf("unknown attribute %q on %#v", name, cur))
+		}
+		v := rv.MapIndex(reflect.ValueOf(name).Convert(rv.Type().Key()))
+		if !v.IsValid() {
+			return nil
+		}
+		return unwrapNilPtr(v)
+
+	case reflect.Struct:
+		if index, ok := fieldIndexByTag(rv.Type(), name); ok {
+			if f, ok := fieldByIndex(rv, index); ok {
+				return unwrapNilPtr(f)
+			}
+			return nil
+		}
+		if sf, ok := rv.Type().FieldByName(name); ok {
+			if f, ok := fieldByIndex(rv, sf.Index); ok {
+				return unwrapNilPtr(f)
+			}
+			return nil
+		}
+		if m := orig.MethodByName(name); m.IsValid() && m.Type().NumIn() == 0 {
+			return callNullaryMethod(m, name)
+		}
+		panic(fmt.Errorf("unknown attribute %q on %#v", name, cur))
+
+	default:
+		if m := orig.MethodByName(name); m.IsValid() && m.Type().NumIn() == 0 {
+			return callNullaryMethod(m, name)
+		}
+		panic(fmt.Errorf("unknown attribute %q on %#v", name, cur))
+	}
+}
+
+// callNullaryMethod calls m, a method taking no arguments, and unwraps a nil
+// pointer result the same way a struct field access does.
+func callNullaryMethod(m reflect.Value, name string) interface{} {
+	out := m.Call(nil)
+	switch len(out) {
+	case 0:
+		return nil
+	case 1:
+		return unwrapNilPtr(out[0])
+	default:
+		panic(fmt.Errorf("method %q returned more than one value", name))
+	}
+}
+
+// unwrapNilPtr returns v.Interface(), except for a nil pointer, which is
+// returned as an untyped nil instead of an interface wrapping a typed nil
+// pointer - otherwise "X == nil" would be false, since Go compares the
+// interface's dynamic type too, not just the pointer value.
+func unwrapNilPtr(v reflect.Value) interface{} {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil
+	}
+	return v.Interface()
+}
+
+// fieldIndexByTag searches t for a field tagged `expr:"name"`, recursing
+// into anonymous (embedded) struct fields breadth-first so a shallower
+// match wins, the same way Go itself resolves promoted field names.
+//
+// visited tracks the struct types already queued, since an embedded field
+// may point back at an ancestor type (directly, or via another embedded
+// struct) - without it, such a cycle would queue the same type forever.
+func fieldIndexByTag(t reflect.Type, name string) ([]int, bool) {
+	type queued struct {
+		t     reflect.Type
+		index []int
+	}
+	queue := []queued{{t, nil}}
+	visited := map[reflect.Type]bool{t: true}
+	for len(queue) > 0 {
+		q := queue[0]
+		queue = queue[1:]
+		if q.t.Kind() != reflect.Struct {
+			continue
+		}
+		for i := 0; i < q.t.NumField(); i++ {
+			f := q.t.Field(i)
+			index := append(append([]int{}, q.index...), i)
+			if tag, ok := f.Tag.Lookup("expr"); ok && tag == name {
+				return index, true
+			}
+			if f.Anonymous {
+				ft := f.Type
+				for ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct && !visited[ft] {
+					visited[ft] = true
+					queue = append(queue, queued{ft, index})
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// fieldByIndex is reflect.Value.FieldByIndex, except a nil pointer partway
+// through the path yields "no value" instead of a panic.
+func fieldByIndex(rv reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 {
+			if rv.Kind() == reflect.Ptr {
+				if rv.IsNil() {
+					return reflect.Value{}, false
+				}
+				rv = rv.Elem()
+			}
+		}
+		rv = rv.Field(x)
+	}
+	return rv, true
+}
@@ -0,0 +1,620 @@
+package expr
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// opcode identifies a single bytecode instruction emitted by compiler and
+// interpreted by run.
+type opcode int
+
+const (
+	opLoadConst    opcode = iota // a indexes Expression.consts
+	opLoadIdent                  // a indexes Expression.idents
+	opLoadSelector               // a indexes Expression.selectors
+	opBinop                      // a is the go/token.Token of the operator
+	opUnop                       // a is a unop
+	opJumpIfFalse                // a is the jump target; pops and tests the top of stack
+	opJumpIfTrue                 // a is the jump target; pops and tests the top of stack
+	opJump                       // a is the jump target
+	opCall                       // a indexes Expression.calls
+	opReturn                     // returns the top of stack
+	opPanic                      // a indexes Expression.consts for a panic message
+)
+
+// instr is a single bytecode instruction: an opcode plus a small integer
+// operand whose meaning depends on the opcode (see the opcode constants).
+type instr struct {
+	op opcode
+	a  int
+}
+
+// unop identifies the operation performed by opUnop. It is a small enum of
+// its own, rather than reusing go/token.Token like opBinop does, because
+// boolCast coercion (used to finish short-circuited && / || chains) has no
+// corresponding Go operator.
+type unop int
+
+const (
+	unopNot unop = iota
+	unopBoolCast
+)
+
+// callInfo describes a compiled call expression: the function name to
+// resolve at eval time (against the Expression's own funcs, then
+// defaultFuncs) and how many of the preceding stack values are its
+// arguments.
+type callInfo struct {
+	name string
+	argc int
+}
+
+// compiler walks a parsed expression tree once and emits a linear bytecode
+// program, pooling literals, identifier names, selector paths and call
+// sites into parallel slices so the VM can index them by small ints
+// instead of re-walking the tree on every Eval.
+type compiler struct {
+	big       bool // literals compile via bigBasicLitValue instead of basicLitValue
+	code      []instr
+	consts    []interface{}
+	idents    []string
+	selectors [][]string
+	calls     []callInfo
+}
+
+func (c *compiler) emit(op opcode, a int) int {
+	c.code = append(c.code, instr{op: op, a: a})
+	return len(c.code) - 1
+}
+
+// patch backfills a previously emitted jump instruction's target with the
+// current end of the program.
+func (c *compiler) patch(pc int) {
+	c.code[pc].a = len(c.code)
+}
+
+func (c *compiler) addConst(v interface{}) int {
+	c.consts = append(c.consts, v)
+	return len(c.consts) - 1
+}
+
+func (c *compiler) addIdent(name string) int {
+	c.idents = append(c.idents, name)
+	return len(c.idents) - 1
+}
+
+func (c *compiler) addSelector(path []string) int {
+	c.selectors = append(c.selectors, path)
+	return len(c.selectors) - 1
+}
+
+func (c *compiler) addCall(name string, argc int) int {
+	c.calls = append(c.calls, callInfo{name: name, argc: argc})
+	return len(c.calls) - 1
+}
+
+// compile emits code for node that leaves exactly one value on the stack.
+//
+// Node kinds go/parser can produce but that have no runtime meaning here
+// (eg. the subscript operator, "I[0]") compile to a single opPanic
+// instruction carrying the same message the tree-walking evaluator used to
+// panic with, rather than failing Compile: this keeps invalid-at-runtime
+// expressions erroring from Eval, not Compile, matching prior behaviour.
+func (c *compiler) compile(node ast.Node) {
+	switch n := node.(type) {
+	case *condExpr:
+		c.compile(n.Cond)
+		jf := c.emit(opJumpIfFalse, 0)
+		c.compile(n.X)
+		jend := c.emit(opJump, 0)
+		c.patch(jf)
+		c.compile(n.Y)
+		c.patch(jend)
+
+	case *ast.ParenExpr:
+		c.compile(n.X)
+
+	case *ast.BasicLit:
+		var v interface{}
+		var err error
+		if c.big {
+			v, err = bigBasicLitValue(n)
+		} else {
+			v, err = basicLitValue(n)
+		}
+		if err != nil {
+			c.emitPanic(err.Error())
+			return
+		}
+		c.emit(opLoadConst, c.addConst(v))
+
+	case *ast.UnaryExpr:
+		if n.Op != token.NOT {
+			c.emitPanic(fmt.Sprintf("unsupported unary operator %s", n.Op))
+			return
+		}
+		c.compile(n.X)
+		c.emit(opUnop, int(unopNot))
+
+	case *ast.Ident:
+		c.emit(opLoadIdent, c.addIdent(n.Name))
+
+	case *ast.SelectorExpr:
+		path, ok := selectorPath(n)
+		if !ok {
+			c.emitPanic("unsupported selector expression")
+			return
+		}
+		c.emit(opLoadSelector, c.addSelector(path))
+
+	case *ast.CallExpr:
+		id, ok := n.Fun.(*ast.Ident)
+		if !ok {
+			c.emitPanic("unsupported call expression")
+			return
+		}
+		for _, a := range n.Args {
+			c.compile(a)
+		}
+		c.emit(opCall, c.addCall(id.Name, len(n.Args)))
+
+	case *ast.BinaryExpr:
+		c.compileBinary(n)
+
+	default:
+		c.emitPanic(fmt.Sprintf("unsupported expression node %#v", node))
+	}
+}
+
+// emitPanic emits an opPanic instruction that, if reached, panics with msg.
+func (c *compiler) emitPanic(msg string) {
+	c.emit(opPanic, c.addConst(msg))
+}
+
+// compileBinary compiles a BinaryExpr. && and || short-circuit: the right
+// operand's code is only reachable when the left operand didn't already
+// decide the result, mirroring what the tree-walking evaluator used to do
+// by simply not recursing into n.Y.
+func (c *compiler) compileBinary(n *ast.BinaryExpr) {
+	switch n.Op {
+	case token.LAND:
+		c.compile(n.X)
+		jf := c.emit(opJumpIfFalse, 0)
+		c.compile(n.Y)
+		c.emit(opUnop, int(unopBoolCast))
+		jend := c.emit(opJump, 0)
+		c.patch(jf)
+		c.emit(opLoadConst, c.addConst(false))
+		c.patch(jend)
+		return
+
+	case token.LOR:
+		c.compile(n.X)
+		jt := c.emit(opJumpIfTrue, 0)
+		c.compile(n.Y)
+		c.emit(opUnop, int(unopBoolCast))
+		jend := c.emit(opJump, 0)
+		c.patch(jt)
+		c.emit(opLoadConst, c.addConst(true))
+		c.patch(jend)
+		return
+	}
+
+	c.compile(n.X)
+	c.compile(n.Y)
+	c.emit(opBinop, int(n.Op))
+}
+
+// basicLitValue parses a literal's textual value once, at compile time,
+// rather than on every Eval.
+func basicLitValue(n *ast.BasicLit) (interface{}, error) {
+	switch n.Kind {
+	case token.STRING:
+		return strconv.Unquote(n.Value)
+	case token.INT:
+		return strconv.ParseInt(n.Value, 10, 64)
+	case token.FLOAT:
+		return strconv.ParseFloat(n.Value, 64)
+	}
+	return nil, fmt.Errorf("unsupported literal kind %s", n.Kind)
+}
+
+// selectorPath flattens a chain of selectors such as "Foo.Bar.Baz" rooted
+// at an identifier into ["Foo", "Bar", "Baz"].
+func selectorPath(e ast.Node) ([]string, bool) {
+	switch n := e.(type) {
+	case *ast.Ident:
+		return []string{n.Name}, true
+	case *ast.SelectorExpr:
+		base, ok := selectorPath(n.X)
+		if !ok {
+			return nil, false
+		}
+		return append(base, n.Sel.Name), true
+	}
+	return nil, false
+}
+
+// stackPool recycles the VM's value stacks across Eval calls, since the
+// bytecode format makes the maximum stack depth of a program cheap to
+// reuse rather than reallocate every time.
+var stackPool = sync.Pool{
+	New: func() interface{} {
+		return make([]interface{}, 0, 8)
+	},
+}
+
+// run executes e's compiled bytecode against value and returns the result.
+// Errors (unknown identifiers reached via a bad cast, a function resolving
+// to nothing, etc.) are reported via panic, as the tree-walking evaluator
+// did, and are recovered by Expression.Eval.
+func run(e *Expression, value V) interface{} {
+	stack := stackPool.Get().([]interface{})[:0]
+	defer func() {
+		stackPool.Put(stack) // nolint: staticcheck
+	}()
+
+	pc := 0
+	for pc < len(e.code) {
+		in := e.code[pc]
+		switch in.op {
+		case opLoadConst:
+			stack = append(stack, e.consts[in.a])
+
+		case opLoadIdent:
+			stack = append(stack, identLookup(value, e.idents[in.a]))
+
+		case opLoadSelector:
+			stack = append(stack, resolveSelector(value, e.selectors[in.a]))
+
+		case opBinop:
+			rhs := stack[len(stack)-1]
+			lhs := stack[len(stack)-2]
+			stack = stack[:len(stack)-2]
+			stack = append(stack, binOp(token.Token(in.a), lhs, rhs))
+
+		case opUnop:
+			v := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			switch unop(in.a) {
+			case unopNot:
+				stack = append(stack, !boolCast(v))
+			case unopBoolCast:
+				stack = append(stack, boolCast(v))
+			}
+
+		case opJumpIfFalse:
+			v := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if !boolCast(v) {
+				pc = in.a
+				continue
+			}
+
+		case opJumpIfTrue:
+			v := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if boolCast(v) {
+				pc = in.a
+				continue
+			}
+
+		case opJump:
+			pc = in.a
+			continue
+
+		case opCall:
+			ci := e.calls[in.a]
+			fn, ok := e.funcs[ci.name]
+			if !ok {
+				fn, ok = defaultFuncs[ci.name]
+			}
+			if !ok {
+				panic(fmt.Errorf("unknown function %q", ci.name))
+			}
+			args := stack[len(stack)-ci.argc:]
+			result := invokeFunc(fn, args)
+			stack = stack[:len(stack)-ci.argc]
+			stack = append(stack, result)
+
+		case opReturn:
+			return stack[len(stack)-1]
+
+		case opPanic:
+			panic(fmt.Errorf("%s", e.consts[in.a]))
+		}
+		pc++
+	}
+	return nil
+}
+
+// identLookup resolves a bare identifier against value, falling back to the
+// true/false keywords when it's absent.
+func identLookup(value V, name string) interface{} {
+	if v, ok := value[name]; ok {
+		return normalize(v)
+	}
+	if name == "true" {
+		return true
+	} else if name == "false" {
+		return false
+	}
+	return nil
+}
+
+// resolveSelector walks a flattened selector path (eg. ["Foo", "Bar"] for
+// "Foo.Bar") against value. Each step beyond the first is resolved with
+// resolveField, so the path may pass through nested V maps, structs,
+// pointers to structs, or map[string]T values.
+func resolveSelector(value V, path []string) interface{} {
+	cur := identLookup(value, path[0])
+	for _, name := range path[1:] {
+		cur = resolveField(cur, name)
+	}
+	return cur
+}
+
+// invokeFunc coerces args to fn's parameter types, calls it via reflection
+// and normalizes the return value.
+func invokeFunc(fn reflect.Value, args []interface{}) interface{} {
+	ft := fn.Type()
+	checkArgc(ft, len(args))
+	in := make([]reflect.Value, len(args))
+	for i, a := range args {
+		in[i] = coerceArg(a, paramType(ft, i))
+	}
+	out := fn.Call(in)
+	switch len(out) {
+	case 0:
+		return nil
+	case 1:
+		return normalize(out[0].Interface())
+	default:
+		panic(fmt.Errorf("function returned more than one value"))
+	}
+}
+
+// checkArgc panics with an error, rather than letting fn.Call panic with a
+// plain string that Eval's recover can't treat as an error, if argc doesn't
+// satisfy ft's arity.
+func checkArgc(ft reflect.Type, argc int) {
+	min := ft.NumIn()
+	if ft.IsVariadic() {
+		min--
+		if argc < min {
+			panic(fmt.Errorf("function expects at least %d argument(s), got %d", min, argc))
+		}
+		return
+	}
+	if argc != min {
+		panic(fmt.Errorf("function expects %d argument(s), got %d", min, argc))
+	}
+}
+
+// paramType returns the type fn expects for argument i, expanding the final
+// variadic parameter as necessary.
+func paramType(ft reflect.Type, i int) reflect.Type {
+	if ft.IsVariadic() && i >= ft.NumIn()-1 {
+		return ft.In(ft.NumIn() - 1).Elem()
+	}
+	return ft.In(i)
+}
+
+// coerceArg converts an already-evaluated value to t, reusing the same
+// casts binOp uses to coerce operands.
+func coerceArg(v interface{}, t reflect.Type) reflect.Value {
+	if t.Kind() == reflect.Interface {
+		if v == nil {
+			return reflect.Zero(t)
+		}
+		return reflect.ValueOf(v)
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return reflect.ValueOf(stringCast(v))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflect.ValueOf(intCast(v)).Convert(t)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return reflect.ValueOf(uintCast(v)).Convert(t)
+	case reflect.Float32, reflect.Float64:
+		return reflect.ValueOf(floatCast(v)).Convert(t)
+	case reflect.Bool:
+		return reflect.ValueOf(boolCast(v))
+	}
+	if v == nil {
+		return reflect.Zero(t)
+	}
+	return reflect.ValueOf(v)
+}
+
+// binOp evaluates a binary operator against two already-evaluated operands.
+// && and || are excluded: they short-circuit, so they're compiled to jumps
+// instead of this opcode.
+func binOp(op token.Token, lhs, rhs interface{}) interface{} {
+	ll := normalize(lhs)
+
+	// Bool is first, to support short-circuit evaluation.
+	if l, ok := ll.(bool); ok {
+		switch op {
+		case token.EQL:
+			return l == boolCast(rhs)
+		case token.NEQ:
+			return l != boolCast(rhs)
+		}
+		panic(fmt.Errorf("unsupported boolean operation"))
+	}
+
+	rr := normalize(rhs)
+
+	if ll == nil {
+		switch op {
+		case token.EQL:
+			return ll == rr
+		case token.NEQ:
+			return ll != rr
+		}
+	}
+
+	if rr == nil {
+		switch op {
+		case token.EQL:
+			return ll == nil
+		case token.NEQ:
+			return ll != nil
+		}
+	} else {
+		rr = normalize(rr)
+	}
+
+	switch l := ll.(type) {
+	case int64:
+		r := intCast(rr)
+		switch op {
+		case token.EQL:
+			return l == r
+		case token.NEQ:
+			return l != r
+		case token.LSS:
+			return l < r
+		case token.GTR:
+			return l > r
+		case token.LEQ:
+			return l <= r
+		case token.GEQ:
+			return l >= r
+
+		case token.ADD:
+			return l + r
+		case token.SUB:
+			return l - r
+		case token.MUL:
+			return l * r
+		case token.QUO:
+			return l / r
+		case token.REM:
+			return l % r
+		case token.SHL:
+			if r < 0 {
+				panic(fmt.Errorf("negative shift count"))
+			}
+			return l << uint64(r)
+		case token.SHR:
+			if r < 0 {
+				panic(fmt.Errorf("negative shift count"))
+			}
+			return l >> uint64(r)
+
+		case token.AND:
+			return l & r
+		case token.OR:
+			return l | r
+		case token.XOR:
+			return l ^ r
+		case token.AND_NOT:
+			return l &^ r
+		}
+
+	case uint64:
+		r := uintCast(rr)
+		switch op {
+		case token.EQL:
+			return l == r
+		case token.NEQ:
+			return l != r
+		case token.LSS:
+			return l < r
+		case token.GTR:
+			return l > r
+		case token.LEQ:
+			return l <= r
+		case token.GEQ:
+			return l >= r
+
+		case token.ADD:
+			return l + r
+		case token.SUB:
+			return l - r
+		case token.MUL:
+			return l * r
+		case token.QUO:
+			return l / r
+		case token.REM:
+			return l % r
+		case token.SHL:
+			return l << r
+		case token.SHR:
+			return l >> r
+
+		case token.AND:
+			return l & r
+		case token.OR:
+			return l | r
+		case token.XOR:
+			return l ^ r
+		case token.AND_NOT:
+			return l &^ r
+		}
+
+	case string:
+		r := stringCast(rr)
+		switch op {
+		case token.ADD:
+			return l + r
+
+		case token.EQL:
+			return l == r
+		case token.NEQ:
+			return l != r
+		case token.LSS:
+			return l < r
+		case token.GTR:
+			return l > r
+		case token.LEQ:
+			return l <= r
+		case token.GEQ:
+			return l >= r
+		}
+
+	case float64:
+		r := floatCast(rr)
+		switch op {
+		case token.ADD:
+			return l + r
+		case token.SUB:
+			return l - r
+		case token.MUL:
+			return l * r
+		case token.QUO:
+			return l / r
+
+		case token.EQL:
+			return l == r
+		case token.NEQ:
+			return l != r
+		case token.LSS:
+			return l < r
+		case token.GTR:
+			return l > r
+		case token.LEQ:
+			return l <= r
+		case token.GEQ:
+			return l >= r
+		}
+
+	default:
+		if ll == nil {
+			return nil
+		}
+		kind := reflect.TypeOf(ll).Kind()
+		if kind == reflect.Map {
+			return ll
+		}
+		panic(fmt.Errorf("unsupported type %#v", ll))
+	}
+	panic(fmt.Errorf("unsupported expression %v %s %v", ll, op, rr))
+}